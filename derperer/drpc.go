@@ -0,0 +1,199 @@
+package derperer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+
+	"go.uber.org/zap"
+	"storj.io/drpc/drpcmux"
+	"storj.io/drpc/drpcserver"
+
+	"github.com/koyangyang/derperer/derpererproto"
+)
+
+// drpcService implements derpererproto.DRPCDERPServiceServer on top of
+// derpMap and the broker derperer feeds from AddFofaResult/Recheck and the
+// prober, so controllers/agents can keep an always-fresh view of the derp
+// fleet without polling /derp.json.
+type drpcService struct {
+	d      *Derperer
+	broker *derpererproto.Broker
+}
+
+// nodeHealth is the subset of prober.NodeResult that publishNodeHealthEvents
+// diffs against to decide whether a node's status actually changed.
+type nodeHealth struct {
+	status string
+	reason string
+}
+
+// GetMap returns derpMap filtered by req.Status; req.LatencyLimit and
+// req.BandwidthLimit are not applied.
+func (s *drpcService) GetMap(ctx context.Context, req *derpererproto.FilterRequest) (*derpererproto.DERPMap, error) {
+	m, err := s.d.derpMap.FilterDERPMap(DERPMapFilter{
+		Status: req.Status,
+	})
+	if err != nil {
+		return nil, err
+	}
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return &derpererproto.DERPMap{JSON: buf}, nil
+}
+
+func (s *drpcService) StreamMap(req *derpererproto.FilterRequest, stream derpererproto.DRPCDERPService_StreamMapStream) error {
+	updates, unsubscribe := s.broker.SubscribeMap()
+	defer unsubscribe()
+
+	// Seed the new subscriber with the map's current state so it doesn't
+	// have to wait for the next diff to have something to show.
+	initial, err := s.GetMap(stream.Context(), req)
+	if err != nil {
+		return err
+	}
+	if err := stream.Send(&derpererproto.MapUpdate{Kind: derpererproto.MapUpdateKind_STATUS_CHANGED, Map: initial}); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case u, ok := <-updates:
+			if !ok {
+				return nil
+			}
+			// Published updates carry the unfiltered map; re-filter it the
+			// same way as the initial snapshot before sending.
+			filtered, err := s.GetMap(stream.Context(), req)
+			if err != nil {
+				return err
+			}
+			if err := stream.Send(&derpererproto.MapUpdate{Kind: u.Kind, NodeName: u.NodeName, Map: filtered}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *drpcService) SubscribeNodeHealth(_ *derpererproto.Empty, stream derpererproto.DRPCDERPService_SubscribeNodeHealthStream) error {
+	events, unsubscribe := s.broker.SubscribeHealth()
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case e, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if err := stream.Send(e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// publishMapUpdate marshals the current derpMap and publishes it to any
+// active StreamMap subscribers, tagged with kind. This is what tells
+// StreamMap subscribers about additions discovered by FetchFofaData.
+func (d *Derperer) publishMapUpdate(kind derpererproto.MapUpdateKind) {
+	buf, err := d.marshalDERPMap()
+	if err != nil {
+		zap.L().Error("failed to marshal derp_map for map update", zap.Error(err))
+		return
+	}
+	d.broker.PublishMapUpdate(&derpererproto.MapUpdate{Kind: kind, Map: &derpererproto.DERPMap{JSON: buf}})
+}
+
+// publishMapUpdateOnChange publishes a STATUS_CHANGED MapUpdate only if
+// derpMap's contents differ from the last time this was called. Map.Recheck
+// runs continuously in the background and doesn't call into the broker
+// itself, so this is polled from the same per-minute tick that already
+// refreshes metrics and health events, to still satisfy derperer.proto's
+// "published whenever ... Map.Recheck change[s] the set of known nodes".
+func (d *Derperer) publishMapUpdateOnChange() {
+	buf, err := d.marshalDERPMap()
+	if err != nil {
+		zap.L().Error("failed to marshal derp_map for map update", zap.Error(err))
+		return
+	}
+
+	d.lastMapMu.Lock()
+	defer d.lastMapMu.Unlock()
+	if d.lastMapJSON != nil && bytes.Equal(buf, d.lastMapJSON) {
+		return
+	}
+	d.lastMapJSON = buf
+
+	d.broker.PublishMapUpdate(&derpererproto.MapUpdate{Kind: derpererproto.MapUpdateKind_STATUS_CHANGED, Map: &derpererproto.DERPMap{JSON: buf}})
+}
+
+// marshalDERPMap returns the full (unfiltered) current derpMap as JSON, the
+// wire format derpererproto.DERPMap carries.
+func (d *Derperer) marshalDERPMap() ([]byte, error) {
+	m, err := d.derpMap.FilterDERPMap(DERPMapFilter{Status: "all"})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(m)
+}
+
+// publishNodeHealthEvents pushes a NodeHealthEvent to any active
+// SubscribeNodeHealth subscribers for every node whose status or reason
+// has changed since the last call, matching derperer.proto's
+// "published whenever a node's probe status changes" contract rather than
+// rebroadcasting the full snapshot on every tick.
+func (d *Derperer) publishNodeHealthEvents() {
+	nodes, _ := d.prober.Snapshot()
+
+	d.lastHealthMu.Lock()
+	defer d.lastHealthMu.Unlock()
+	if d.lastHealth == nil {
+		d.lastHealth = make(map[string]nodeHealth, len(nodes))
+	}
+
+	for name, r := range nodes {
+		current := nodeHealth{status: string(r.Status), reason: r.Reason}
+		if prev, ok := d.lastHealth[name]; ok && prev == current {
+			continue
+		}
+		d.lastHealth[name] = current
+		d.broker.PublishNodeHealth(&derpererproto.NodeHealthEvent{
+			NodeName: name,
+			Status:   current.status,
+			Reason:   current.reason,
+		})
+	}
+}
+
+// startDRPC listens on config.DRPCAddress (if set) and serves
+// derpererproto.DERPService alongside the Fiber app.
+func (d *Derperer) startDRPC() {
+	if d.config.DRPCAddress == "" {
+		return
+	}
+
+	lis, err := net.Listen("tcp", d.config.DRPCAddress)
+	if err != nil {
+		zap.L().Error("failed to listen for drpc", zap.Error(err))
+		return
+	}
+
+	mux := drpcmux.New()
+	if err := derpererproto.DRPCRegisterDERPService(mux, &drpcService{d: d, broker: d.broker}); err != nil {
+		zap.L().Error("failed to register drpc service", zap.Error(err))
+		return
+	}
+
+	srv := drpcserver.New(mux)
+	zap.L().Info("serving drpc", zap.String("address", d.config.DRPCAddress))
+	if err := srv.Serve(d.ctx, lis); err != nil {
+		zap.L().Error("drpc server stopped", zap.Error(err))
+	}
+}
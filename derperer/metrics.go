@@ -0,0 +1,144 @@
+package derperer
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gofiber/adaptor/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	fofaFetchTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "derperer",
+		Subsystem: "fofa",
+		Name:      "fetch_total",
+		Help:      "Total number of FOFA fetch attempts, by result.",
+	}, []string{"result"})
+
+	fofaFetchDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "derperer",
+		Subsystem: "fofa",
+		Name:      "fetch_duration_seconds",
+		Help:      "Duration of a full FOFA fetch pass.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	derpNodes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "derperer",
+		Subsystem: "derp",
+		Name:      "nodes",
+		Help:      "Number of DERP nodes currently known, by status.",
+	}, []string{"status"})
+
+	derpNodeLatency = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "derperer",
+		Subsystem: "derp",
+		Name:      "node_latency_seconds",
+		Help:      "Last observed latency of a DERP node.",
+	}, []string{"region", "node"})
+
+	derpNodeBandwidth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "derperer",
+		Subsystem: "derp",
+		Name:      "node_bandwidth_bps",
+		Help:      "Last observed bandwidth of a DERP node, in bits per second.",
+	}, []string{"region", "node"})
+
+	tailscaleACLUpdateTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "derperer",
+		Subsystem: "tailscale",
+		Name:      "acl_update_total",
+		Help:      "Total number of Tailscale ACL update attempts, by result.",
+	}, []string{"result"})
+
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "derperer",
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Total number of HTTP requests, by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "derperer",
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of HTTP requests, by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		fofaFetchTotal,
+		fofaFetchDuration,
+		derpNodes,
+		derpNodeLatency,
+		derpNodeBandwidth,
+		tailscaleACLUpdateTotal,
+		httpRequestsTotal,
+		httpRequestDuration,
+	)
+}
+
+// metricsMiddleware records httpRequestsTotal/httpRequestDuration for every
+// request that passes through app.
+func metricsMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+		err := c.Next()
+
+		route := c.Route().Path
+		method := c.Method()
+		status := strconv.Itoa(c.Response().StatusCode())
+
+		httpRequestsTotal.WithLabelValues(route, method, status).Inc()
+		httpRequestDuration.WithLabelValues(route, method).Observe(time.Since(start).Seconds())
+
+		return err
+	}
+}
+
+// registerMetrics mounts /metrics on the given router, wrapping the standard
+// prometheus client_golang HTTP handler for Fiber.
+func registerMetrics(r fiber.Router) {
+	r.Get("/metrics", adaptor.HTTPHandler(promhttp.Handler()))
+}
+
+// updateDERPNodeMetrics refreshes the derperer_derp_nodes gauge from the
+// current contents of m, reusing the same alive/error status filtering
+// /derp.json?status= uses.
+func updateDERPNodeMetrics(m *Map) {
+	derpNodes.WithLabelValues("alive").Set(float64(countNodes(m, "alive")))
+	derpNodes.WithLabelValues("error").Set(float64(countNodes(m, "error")))
+}
+
+// updateDERPNodeLatencyMetrics refreshes derperer_derp_node_latency_seconds
+// and derperer_derp_node_bandwidth_bps from the prober's latest UDP/STUN
+// measurements.
+func (d *Derperer) updateDERPNodeLatencyMetrics() {
+	for _, n := range d.allNodes() {
+		r, ok := d.prober.NodeStatus(n.Name)
+		if !ok || r.RTT == 0 {
+			continue
+		}
+		derpNodeLatency.WithLabelValues(strconv.Itoa(n.RegionID), n.Name).Set(r.RTT.Seconds())
+		if r.BandwidthBps > 0 {
+			derpNodeBandwidth.WithLabelValues(strconv.Itoa(n.RegionID), n.Name).Set(r.BandwidthBps)
+		}
+	}
+}
+
+func countNodes(m *Map, status string) int {
+	filtered, err := m.FilterDERPMap(DERPMapFilter{Status: status})
+	if err != nil {
+		return 0
+	}
+	var n int
+	for _, region := range filtered.Regions {
+		n += len(region.Nodes)
+	}
+	return n
+}
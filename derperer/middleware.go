@@ -0,0 +1,81 @@
+package derperer
+
+import (
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
+)
+
+// publicRateLimiter returns a per-IP rate limiter allowing perMinute
+// requests per minute, or a no-op passthrough if perMinute <= 0.
+func publicRateLimiter(perMinute int) fiber.Handler {
+	if perMinute <= 0 {
+		return func(c *fiber.Ctx) error { return c.Next() }
+	}
+	return limiter.New(limiter.Config{
+		Max:        perMinute,
+		Expiration: time.Minute,
+	})
+}
+
+// updateTokenLimiter returns a rate limiter allowing perMinute requests per
+// minute to a single update token, or a no-op passthrough if perMinute <=
+// 0. Unlike publicRateLimiter, this keys on the caller's update token
+// rather than source IP, so multiple token-holders behind the same
+// NAT/proxy don't throttle each other. If a request carries no token (only
+// possible when DerpererConfig.UpdateTokens is empty, so requireUpdateToken
+// isn't rejecting it), it falls back to keying on IP like publicLimiter,
+// since an empty-string key would otherwise bucket every tokenless caller
+// together and let one of them exhaust the shared quota for all the rest.
+func updateTokenLimiter(perMinute int) fiber.Handler {
+	if perMinute <= 0 {
+		return func(c *fiber.Ctx) error { return c.Next() }
+	}
+	return limiter.New(limiter.Config{
+		Max:        perMinute,
+		Expiration: time.Minute,
+		KeyGenerator: func(c *fiber.Ctx) string {
+			if t, ok := c.Locals(updateTokenLocalsKey).(string); ok && t != "" {
+				return t
+			}
+			return c.IP()
+		},
+	})
+}
+
+// updateTokenLocalsKey stashes the token requireUpdateToken already parsed
+// off the request so updateTokenLimiter's KeyGenerator doesn't reparse it.
+const updateTokenLocalsKey = "updateToken"
+
+// requireUpdateToken rejects any /update request that doesn't present one
+// of tokens, either as ?token= or an Authorization: Bearer header. If
+// tokens is empty, every request is allowed through, matching the
+// pre-existing (tokenless) behavior of this endpoint.
+func requireUpdateToken(tokens []string) fiber.Handler {
+	allowed := make(map[string]struct{}, len(tokens))
+	for _, t := range tokens {
+		allowed[t] = struct{}{}
+	}
+	return func(c *fiber.Ctx) error {
+		token := updateToken(c)
+		c.Locals(updateTokenLocalsKey, token)
+		if len(allowed) == 0 {
+			return c.Next()
+		}
+		if _, ok := allowed[token]; !ok {
+			return fiber.ErrUnauthorized
+		}
+		return c.Next()
+	}
+}
+
+// updateToken extracts the caller-supplied update token from the query
+// string or Authorization: Bearer header.
+func updateToken(c *fiber.Ctx) string {
+	if t := c.Query("token"); t != "" {
+		return t
+	}
+	return strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+}
@@ -0,0 +1,52 @@
+package derperer
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// TestRequireUpdateTokenStashesParsedToken checks that requireUpdateToken
+// parses the caller's token once and stashes it via c.Locals, so
+// updateTokenLimiter's KeyGenerator can read it back without reparsing and
+// key on it instead of falling back to the caller's IP.
+func TestRequireUpdateTokenStashesParsedToken(t *testing.T) {
+	app := fiber.New()
+	app.Use(requireUpdateToken([]string{"good-token"}))
+	app.Get("/update", func(c *fiber.Ctx) error {
+		got, _ := c.Locals(updateTokenLocalsKey).(string)
+		if got != "good-token" {
+			t.Fatalf("expected stashed token %q, got %q", "good-token", got)
+		}
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	req := httptest.NewRequest(fiber.MethodGet, "/update?token=good-token", nil)
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test: %v", err)
+	}
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected status %d, got %d", fiber.StatusOK, resp.StatusCode)
+	}
+}
+
+// TestRequireUpdateTokenRejectsUnknownToken checks that a request bearing a
+// token not in the allowed set is rejected before reaching the handler.
+func TestRequireUpdateTokenRejectsUnknownToken(t *testing.T) {
+	app := fiber.New()
+	app.Use(requireUpdateToken([]string{"good-token"}))
+	app.Get("/update", func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	req := httptest.NewRequest(fiber.MethodGet, "/update?token=wrong-token", nil)
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test: %v", err)
+	}
+	if resp.StatusCode != fiber.StatusUnauthorized {
+		t.Fatalf("expected status %d, got %d", fiber.StatusUnauthorized, resp.StatusCode)
+	}
+}
@@ -0,0 +1,47 @@
+package prober
+
+import (
+	"context"
+	"time"
+)
+
+// RunUDPLoop ticks RunUDPProbe at the configured UDPInterval until ctx is
+// canceled. It is meant to be run in its own goroutine (e.g. via
+// conc.WaitGroup.Go).
+func (p *Prober) RunUDPLoop(ctx context.Context, nodes NodesFunc) {
+	p.runLoop(ctx, p.config.UDPInterval, func() {
+		p.RunUDPProbe(ctx, nodes())
+	})
+}
+
+// RunTLSLoop ticks RunTLSProbe at the configured TLSInterval until ctx is
+// canceled.
+func (p *Prober) RunTLSLoop(ctx context.Context, nodes NodesFunc) {
+	p.runLoop(ctx, p.config.TLSInterval, func() {
+		p.RunTLSProbe(nodes())
+	})
+}
+
+// RunMeshLoop ticks RunMeshProbe at the configured MeshInterval until ctx is
+// canceled.
+func (p *Prober) RunMeshLoop(ctx context.Context, nodes NodesFunc) {
+	p.runLoop(ctx, p.config.MeshInterval, func() {
+		p.RunMeshProbe(ctx, nodes())
+	})
+}
+
+func (p *Prober) runLoop(ctx context.Context, interval time.Duration, tick func()) {
+	if interval <= 0 {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		tick()
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package prober
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+
+	"github.com/sourcegraph/conc/pool"
+	"tailscale.com/derp"
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// RunMeshProbe checks, for every ordered pair (A,B) of nodes, that a
+// client connected to A as an ephemeral node can deliver a packet to a
+// client connected to B. The packet only arrives if A and B are the same
+// server or A forwards packets to B (DERP mesh packet forwarding); any
+// other pair is recorded as bad once MeshTimeout expires.
+func (p *Prober) RunMeshProbe(ctx context.Context, nodes []*tailcfg.DERPNode) {
+	pl := pool.New().WithMaxGoroutines(4)
+	for _, a := range nodes {
+		for _, b := range nodes {
+			if a.Name == b.Name {
+				continue
+			}
+			a, b := a, b
+			pl.Go(func() {
+				p.probePair(ctx, a, b)
+			})
+		}
+	}
+	pl.Wait()
+}
+
+func (p *Prober) probePair(ctx context.Context, a, b *tailcfg.DERPNode) {
+	ctx, cancel := context.WithTimeout(ctx, p.config.MeshTimeout)
+	defer cancel()
+
+	keyA := key.NewNode()
+	keyB := key.NewNode()
+
+	clientA := derphttp.NewRegionClient(keyA, p.logf, nil, func() *tailcfg.DERPRegion {
+		return &tailcfg.DERPRegion{Nodes: []*tailcfg.DERPNode{a}}
+	})
+	defer clientA.Close()
+
+	clientB := derphttp.NewRegionClient(keyB, p.logf, nil, func() *tailcfg.DERPRegion {
+		return &tailcfg.DERPRegion{Nodes: []*tailcfg.DERPNode{b}}
+	})
+	defer clientB.Close()
+
+	if err := clientA.Connect(ctx); err != nil {
+		p.recordPair(a.Name, b.Name, false, fmt.Sprintf("connect to %s: %v", a.Name, err))
+		return
+	}
+	if err := clientB.Connect(ctx); err != nil {
+		p.recordPair(a.Name, b.Name, false, fmt.Sprintf("connect to %s: %v", b.Name, err))
+		return
+	}
+
+	payload := make([]byte, 32)
+	if _, err := rand.Read(payload); err != nil {
+		p.recordPair(a.Name, b.Name, false, fmt.Sprintf("generate payload: %v", err))
+		return
+	}
+
+	if err := clientA.Send(keyB.Public(), payload); err != nil {
+		p.recordPair(a.Name, b.Name, false, fmt.Sprintf("send: %v", err))
+		return
+	}
+
+	received := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := clientB.Recv()
+			if err != nil {
+				received <- err
+				return
+			}
+			if pkt, ok := msg.(derp.ReceivedPacket); ok {
+				if pkt.Source == keyA.Public() {
+					received <- nil
+					return
+				}
+			}
+		}
+	}()
+
+	select {
+	case err := <-received:
+		if err != nil {
+			p.recordPair(a.Name, b.Name, false, fmt.Sprintf("recv: %v", err))
+			return
+		}
+		p.recordPair(a.Name, b.Name, true, "")
+	case <-ctx.Done():
+		p.recordPair(a.Name, b.Name, false, "timed out waiting for relayed packet")
+	}
+}
@@ -0,0 +1,86 @@
+package prober
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"tailscale.com/derp"
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// newTestDERPServer starts a local derp.Server bound to 127.0.0.1 and
+// returns a *tailcfg.DERPNode describing it, along with a cleanup func.
+func newTestDERPServer(t *testing.T, name string) (*tailcfg.DERPNode, func()) {
+	t.Helper()
+
+	priv := key.NewNode()
+	s := derp.NewServer(priv, t.Logf)
+
+	httpsrv := httptest.NewServer(derphttp.Handler(s))
+
+	host, portStr, err := net.SplitHostPort(httpsrv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("splitting %q: %v", httpsrv.Listener.Addr().String(), err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		t.Fatalf("parsing port %q: %v", portStr, err)
+	}
+
+	node := &tailcfg.DERPNode{
+		Name:             name,
+		RegionID:         900,
+		HostName:         host,
+		DERPPort:         port,
+		InsecureForTests: true,
+	}
+
+	return node, func() {
+		httpsrv.Close()
+		s.Close()
+	}
+}
+
+// TestMeshProbeLocalServers sanity-checks probePair's Send/Recv wiring by
+// pointing both ephemeral clients at the *same* local derp.Server. Two
+// independent servers would need real inter-region packet forwarding
+// (derp.Server.AddPacketForwarder, as used between actual DERP regions)
+// for a packet sent on one to ever reach a client connected only to the
+// other; this test isn't exercising that, just that probePair correctly
+// connects, sends, and receives through whatever DERP connectivity exists
+// between the two named nodes.
+func TestMeshProbeLocalServers(t *testing.T) {
+	srv, cleanup := newTestDERPServer(t, "test-a")
+	defer cleanup()
+
+	nodeA := srv
+	nodeB := &tailcfg.DERPNode{
+		Name:             "test-b",
+		RegionID:         srv.RegionID,
+		HostName:         srv.HostName,
+		DERPPort:         srv.DERPPort,
+		InsecureForTests: true,
+	}
+
+	p := New(Config{MeshTimeout: 5 * time.Second})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	p.RunMeshProbe(ctx, []*tailcfg.DERPNode{nodeA, nodeB})
+
+	_, pairs := p.Snapshot()
+	status, ok := pairs[PairKey{A: nodeA.Name, B: nodeB.Name}]
+	if !ok {
+		t.Fatalf("no pair status recorded for %s -> %s", nodeA.Name, nodeB.Name)
+	}
+	if status.Status != StatusGood {
+		t.Fatalf("expected good mesh status, got %q: %s", status.Status, status.Reason)
+	}
+}
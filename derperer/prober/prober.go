@@ -0,0 +1,256 @@
+// Package prober runs periodic health probes (UDP/STUN, TLS certificate, and
+// mesh reachability) against the nodes of a DERP map and tracks their
+// results so that callers can evict flaky or expiring relays before they are
+// pushed into a Tailscale ACL.
+package prober
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"tailscale.com/tailcfg"
+)
+
+// Status is the coarse-grained health of a node or node pair.
+type Status string
+
+const (
+	StatusGood    Status = "good"
+	StatusBad     Status = "bad"
+	StatusUnknown Status = "unknown"
+)
+
+// Config controls probe cadence and thresholds. Zero-value port, timeout,
+// CertWarnThreshold and EvictAfter fields fall back to the defaults in
+// withDefaults; a zero interval disables that probe loop, and a zero
+// CertReissueAfter disables the reissue check.
+type Config struct {
+	// UDPInterval is how often the STUN binding probe runs against every node.
+	UDPInterval time.Duration
+	// TLSInterval is how often the TLS certificate probe runs against every node.
+	TLSInterval time.Duration
+	// MeshInterval is how often the pairwise DERP relay probe runs.
+	MeshInterval time.Duration
+	// STUNPort is the UDP port to send STUN binding requests to. Defaults to 3478.
+	STUNPort int
+	// STUNTimeout bounds how long we wait for a STUN binding response.
+	STUNTimeout time.Duration
+	// TLSTimeout bounds the TLS handshake used for the cert probe.
+	TLSTimeout time.Duration
+	// MeshTimeout bounds how long we wait for a mesh payload to arrive.
+	MeshTimeout time.Duration
+	// CertWarnThreshold marks a node unhealthy once its leaf cert's NotAfter
+	// is within this duration of expiring. Defaults to 14 days.
+	CertWarnThreshold time.Duration
+	// CertReissueAfter, if non-zero, marks a node unhealthy if its leaf cert
+	// was issued (NotBefore) before this time. Used to force rotation of
+	// certs that predate a known revocation event.
+	CertReissueAfter time.Time
+	// EvictAfter is how many consecutive UDP or TLS probe failures a node
+	// must accrue before it is considered evictable. Defaults to 3.
+	EvictAfter int
+}
+
+func (c Config) withDefaults() Config {
+	if c.STUNPort == 0 {
+		c.STUNPort = 3478
+	}
+	if c.STUNTimeout == 0 {
+		c.STUNTimeout = 5 * time.Second
+	}
+	if c.TLSTimeout == 0 {
+		c.TLSTimeout = 10 * time.Second
+	}
+	if c.MeshTimeout == 0 {
+		c.MeshTimeout = 10 * time.Second
+	}
+	if c.CertWarnThreshold == 0 {
+		c.CertWarnThreshold = 14 * 24 * time.Hour
+	}
+	if c.EvictAfter == 0 {
+		c.EvictAfter = 3
+	}
+	return c
+}
+
+// NodeResult is the latest known health of a single DERP node.
+type NodeResult struct {
+	Status Status        `json:"status"`
+	Reason string        `json:"reason,omitempty"`
+	RTT    time.Duration `json:"rtt,omitempty"`
+	// BandwidthBps is a rough throughput estimate derived from the
+	// UDP/STUN probe's response size and RTT (bits/second). It's not a
+	// dedicated throughput test, just the best approximation the existing
+	// probes can give without adding one.
+	BandwidthBps float64   `json:"bandwidthBps,omitempty"`
+	CertExpiry   time.Time `json:"certExpiry,omitempty"`
+	LastChecked  time.Time `json:"lastChecked"`
+
+	// udpConsecutiveFailures and tlsConsecutiveFailures are tracked
+	// independently: a node can be reachable over TLS but firewalled for
+	// STUN (or vice versa), and a success on one probe shouldn't erase a
+	// failure streak accrued by the other.
+	udpConsecutiveFailures int
+	tlsConsecutiveFailures int
+}
+
+// probeKind identifies which probe loop produced a NodeResult update, so
+// recordResult can track each probe's failure streak independently.
+type probeKind int
+
+const (
+	probeUDP probeKind = iota
+	probeTLS
+)
+
+// PairKey identifies an ordered pair of nodes for a mesh probe.
+type PairKey struct {
+	A string `json:"a"`
+	B string `json:"b"`
+}
+
+// PairStatus is the latest known mesh reachability between two nodes.
+type PairStatus struct {
+	Status      Status    `json:"status"`
+	Reason      string    `json:"reason,omitempty"`
+	LastChecked time.Time `json:"lastChecked"`
+}
+
+// Prober owns the health state accumulated from the three probe loops. The
+// zero value is not usable; construct with New.
+type Prober struct {
+	config Config
+	logf   func(format string, args ...any)
+
+	mu    sync.RWMutex
+	nodes map[string]*NodeResult
+	pairs map[PairKey]*PairStatus
+
+	certMu    sync.Mutex
+	certCache map[string]*certCacheEntry
+}
+
+// New returns a Prober ready to have its probe loops started.
+func New(config Config) *Prober {
+	return &Prober{
+		config:    config.withDefaults(),
+		logf:      zap.S().Infof,
+		nodes:     make(map[string]*NodeResult),
+		pairs:     make(map[PairKey]*PairStatus),
+		certCache: make(map[string]*certCacheEntry),
+	}
+}
+
+// NodeStatus returns the current result for a node, or (NodeResult{}, false) if it
+// has not been probed yet.
+func (p *Prober) NodeStatus(nodeName string) (NodeResult, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	r, ok := p.nodes[nodeName]
+	if !ok {
+		return NodeResult{}, false
+	}
+	return *r, true
+}
+
+// Snapshot returns a copy of all known node and pair results, suitable for
+// serving over the /probe/status endpoints.
+func (p *Prober) Snapshot() (nodes map[string]NodeResult, pairs map[PairKey]PairStatus) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	nodes = make(map[string]NodeResult, len(p.nodes))
+	for k, v := range p.nodes {
+		nodes[k] = *v
+	}
+	pairs = make(map[PairKey]PairStatus, len(p.pairs))
+	for k, v := range p.pairs {
+		pairs[k] = *v
+	}
+	return nodes, pairs
+}
+
+// ShouldEvict reports whether a node has failed UDP or TLS probes enough
+// consecutive times (tracked independently per probe) that it should be
+// dropped from results handed to Tailscale ACL updates.
+func (p *Prober) ShouldEvict(nodeName string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	r, ok := p.nodes[nodeName]
+	if !ok {
+		return false
+	}
+	return r.udpConsecutiveFailures >= p.config.EvictAfter || r.tlsConsecutiveFailures >= p.config.EvictAfter
+}
+
+func (p *Prober) recordResult(nodeName string, probe probeKind, ok bool, reason string, rtt time.Duration, certExpiry time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r, exists := p.nodes[nodeName]
+	if !exists {
+		r = &NodeResult{}
+		p.nodes[nodeName] = r
+	}
+	r.LastChecked = time.Now()
+	if rtt > 0 {
+		r.RTT = rtt
+	}
+	if !certExpiry.IsZero() {
+		r.CertExpiry = certExpiry
+	}
+	if ok {
+		r.Status = StatusGood
+		r.Reason = ""
+	} else {
+		r.Status = StatusBad
+		r.Reason = reason
+	}
+
+	var streak *int
+	switch probe {
+	case probeUDP:
+		streak = &r.udpConsecutiveFailures
+	case probeTLS:
+		streak = &r.tlsConsecutiveFailures
+	}
+	if ok {
+		*streak = 0
+	} else {
+		*streak++
+	}
+}
+
+// recordBandwidth updates a node's BandwidthBps estimate. It's a no-op if
+// the node hasn't had a recordResult call yet.
+func (p *Prober) recordBandwidth(nodeName string, bps float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r, ok := p.nodes[nodeName]
+	if !ok {
+		return
+	}
+	r.BandwidthBps = bps
+}
+
+func (p *Prober) recordPair(a, b string, ok bool, reason string) {
+	key := PairKey{A: a, B: b}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, exists := p.pairs[key]
+	if !exists {
+		s = &PairStatus{}
+		p.pairs[key] = s
+	}
+	s.LastChecked = time.Now()
+	if ok {
+		s.Status = StatusGood
+		s.Reason = ""
+	} else {
+		s.Status = StatusBad
+		s.Reason = reason
+	}
+}
+
+// NodesFunc supplies the current set of DERP nodes to probe. It is called at
+// the start of every probe tick so the prober always probes the live map.
+type NodesFunc func() []*tailcfg.DERPNode
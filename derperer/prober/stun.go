@@ -0,0 +1,74 @@
+package prober
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sourcegraph/conc/pool"
+	"tailscale.com/net/stun"
+	"tailscale.com/tailcfg"
+)
+
+// RunUDPProbe sends a STUN binding request to the configured STUNPort on
+// every node and records whether a valid binding response came back within
+// the configured timeout.
+func (p *Prober) RunUDPProbe(ctx context.Context, nodes []*tailcfg.DERPNode) {
+	pl := pool.New().WithMaxGoroutines(8)
+	for _, n := range nodes {
+		n := n
+		pl.Go(func() {
+			p.probeNodeUDP(ctx, n)
+		})
+	}
+	pl.Wait()
+}
+
+func (p *Prober) probeNodeUDP(ctx context.Context, n *tailcfg.DERPNode) {
+	ip := n.IPv4
+	if ip == "" {
+		ip = n.HostName
+	}
+	addr := net.JoinHostPort(ip, fmt.Sprintf("%d", p.config.STUNPort))
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		p.recordResult(n.Name, probeUDP, false, fmt.Sprintf("stun dial: %v", err), 0, time.Time{})
+		return
+	}
+	defer conn.Close()
+
+	txID := stun.NewTxID()
+	req := stun.Request(txID)
+
+	start := time.Now()
+	_ = conn.SetDeadline(time.Now().Add(p.config.STUNTimeout))
+	if _, err := conn.Write(req); err != nil {
+		p.recordResult(n.Name, probeUDP, false, fmt.Sprintf("stun write: %v", err), 0, time.Time{})
+		return
+	}
+
+	buf := make([]byte, 1024)
+	sz, err := conn.Read(buf)
+	if err != nil {
+		p.recordResult(n.Name, probeUDP, false, fmt.Sprintf("stun read: %v", err), 0, time.Time{})
+		return
+	}
+	rtt := time.Since(start)
+
+	gotTxID, _, err := stun.ParseResponse(buf[:sz])
+	if err != nil {
+		p.recordResult(n.Name, probeUDP, false, fmt.Sprintf("stun parse: %v", err), rtt, time.Time{})
+		return
+	}
+	if gotTxID != txID {
+		p.recordResult(n.Name, probeUDP, false, "stun response txid mismatch", rtt, time.Time{})
+		return
+	}
+
+	p.recordResult(n.Name, probeUDP, true, "", rtt, time.Time{})
+	if rtt > 0 {
+		p.recordBandwidth(n.Name, float64(sz*8)/rtt.Seconds())
+	}
+}
@@ -0,0 +1,123 @@
+package prober
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sourcegraph/conc/pool"
+	"tailscale.com/tailcfg"
+)
+
+// certCacheEntry is the cached result of a previous TLS probe for a
+// hostname, reused by probes of that hostname that land within
+// certCacheTTL of each other so they don't redial and re-handshake for
+// cert data that hasn't had time to change.
+type certCacheEntry struct {
+	cert      *x509.Certificate
+	verified  bool
+	fetchedAt time.Time
+}
+
+// certCacheTTL bounds how long a cached leaf cert is reused before a probe
+// redials to get a fresh one.
+func (c Config) certCacheTTL() time.Duration {
+	if c.TLSInterval > 0 {
+		return c.TLSInterval
+	}
+	return 5 * time.Minute
+}
+
+// RunTLSProbe dials every node's HostName on :443, completes a TLS
+// handshake, and marks the node unhealthy if the leaf certificate is
+// expiring soon, predates CertReissueAfter, or the chain doesn't verify.
+// Parsed leaf certificates are cached by hostname so repeat probes within
+// certCacheTTL reuse the cached cert instead of redialing.
+func (p *Prober) RunTLSProbe(nodes []*tailcfg.DERPNode) {
+	pl := pool.New().WithMaxGoroutines(8)
+	for _, n := range nodes {
+		n := n
+		pl.Go(func() {
+			p.probeNodeTLS(n)
+		})
+	}
+	pl.Wait()
+}
+
+func (p *Prober) probeNodeTLS(n *tailcfg.DERPNode) {
+	if cached, ok := p.cachedCertEntry(n.HostName); ok {
+		p.evaluateCert(n, cached.cert, cached.verified)
+		return
+	}
+
+	addr := net.JoinHostPort(n.HostName, "443")
+
+	dialer := &net.Dialer{Timeout: p.config.TLSTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{})
+	if err != nil {
+		p.recordResult(n.Name, probeTLS, false, fmt.Sprintf("tls dial: %v", err), 0, time.Time{})
+		return
+	}
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		p.recordResult(n.Name, probeTLS, false, "tls: no peer certificates", 0, time.Time{})
+		return
+	}
+	leaf := state.PeerCertificates[0]
+	verified := len(state.VerifiedChains) > 0
+
+	p.certMu.Lock()
+	p.certCache[n.HostName] = &certCacheEntry{cert: leaf, verified: verified, fetchedAt: time.Now()}
+	p.certMu.Unlock()
+
+	p.evaluateCert(n, leaf, verified)
+}
+
+// evaluateCert applies the expiry/reissue/verification checks shared by
+// both a freshly dialed cert and a cache hit, and records the result.
+func (p *Prober) evaluateCert(n *tailcfg.DERPNode, leaf *x509.Certificate, verified bool) {
+	if !verified {
+		p.recordResult(n.Name, probeTLS, false, "tls: certificate chain did not verify", 0, leaf.NotAfter)
+		return
+	}
+
+	if until := time.Until(leaf.NotAfter); until < p.config.CertWarnThreshold {
+		p.recordResult(n.Name, probeTLS, false, fmt.Sprintf("tls: certificate expires in %s", until.Round(time.Second)), 0, leaf.NotAfter)
+		return
+	}
+
+	if !p.config.CertReissueAfter.IsZero() && leaf.NotBefore.Before(p.config.CertReissueAfter) {
+		p.recordResult(n.Name, probeTLS, false, fmt.Sprintf("tls: certificate issued %s, before required reissue cutoff %s", leaf.NotBefore, p.config.CertReissueAfter), 0, leaf.NotAfter)
+		return
+	}
+
+	p.recordResult(n.Name, probeTLS, true, "", 0, leaf.NotAfter)
+}
+
+// cachedCertEntry returns the cached cert entry for hostname if it's still
+// within certCacheTTL.
+func (p *Prober) cachedCertEntry(hostname string) (*certCacheEntry, bool) {
+	p.certMu.Lock()
+	defer p.certMu.Unlock()
+	e, ok := p.certCache[hostname]
+	if !ok || time.Since(e.fetchedAt) > p.config.certCacheTTL() {
+		return nil, false
+	}
+	return e, true
+}
+
+// CachedCert returns the most recently observed leaf certificate for a
+// hostname, if any, regardless of its age.
+func (p *Prober) CachedCert(hostname string) (*x509.Certificate, bool) {
+	p.certMu.Lock()
+	defer p.certMu.Unlock()
+	e, ok := p.certCache[hostname]
+	if !ok {
+		return nil, false
+	}
+	return e.cert, true
+}
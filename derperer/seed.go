@@ -0,0 +1,170 @@
+package derperer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+	"tailscale.com/paths"
+	"tailscale.com/tailcfg"
+)
+
+// DERPMapSource selects where Derperer's seed DERP map comes from, in
+// addition to (or instead of) FOFA scraping.
+type DERPMapSource string
+
+const (
+	// DERPMapSourceFofa is the default: the map is built up entirely from
+	// FetchFofaData results.
+	DERPMapSourceFofa DERPMapSource = "fofa"
+	// DERPMapSourceTailscaled seeds the map from a local tailscaled's
+	// LocalAPI, letting Derperer act as a monitoring aggregator for an
+	// existing Tailscale deployment.
+	DERPMapSourceTailscaled DERPMapSource = "tailscaled"
+	// DERPMapSourceURL fetches a tailcfg.DERPMap as JSON from a URL.
+	DERPMapSourceURL DERPMapSource = "url"
+	// DERPMapSourceFile reads a tailcfg.DERPMap as JSON from a local file.
+	DERPMapSourceFile DERPMapSource = "file"
+)
+
+// loadSeedDERPMap loads the configured DERPMapSource (if any) into
+// d.seedMap. d.derpMap has no notion of a "trusted, skip FOFA verification"
+// entry, so the seed map is kept alongside it and merged in wherever
+// derperer hands a *tailcfg.DERPMap back out (see mergeSeedMap).
+func (d *Derperer) loadSeedDERPMap() error {
+	logger := zap.L()
+
+	var (
+		m   *tailcfg.DERPMap
+		err error
+	)
+
+	switch d.config.DERPMapSource {
+	case "", DERPMapSourceFofa:
+		return nil
+	case DERPMapSourceTailscaled:
+		m, err = fetchTailscaledDERPMap(d.ctx)
+	case DERPMapSourceURL:
+		m, err = fetchURLDERPMap(d.ctx, d.config.DERPMapSourceURL)
+	case DERPMapSourceFile:
+		m, err = fetchFileDERPMap(d.config.DERPMapSourceURL)
+	default:
+		return fmt.Errorf("unknown derp map source %q", d.config.DERPMapSource)
+	}
+	if err != nil {
+		return fmt.Errorf("loading seed derp map from %q: %w", d.config.DERPMapSource, err)
+	}
+
+	logger.Info("loaded seed derp map",
+		zap.String("source", string(d.config.DERPMapSource)),
+		zap.Int("regions", len(m.Regions)))
+	d.seedMap = m
+
+	return nil
+}
+
+// mergeSeedMap adds any regions from d.seedMap that aren't already present
+// in m, in place. It's a no-op if no DERPMapSource was configured.
+func (d *Derperer) mergeSeedMap(m *tailcfg.DERPMap) {
+	if d.seedMap == nil {
+		return
+	}
+	if m.Regions == nil {
+		m.Regions = make(map[int]*tailcfg.DERPRegion, len(d.seedMap.Regions))
+	}
+	for id, region := range d.seedMap.Regions {
+		if _, exists := m.Regions[id]; !exists {
+			// Clone so in-place rewrites of m (eviction, overrides,
+			// force-websockets) never alter d.seedMap itself.
+			m.Regions[id] = region.Clone()
+		}
+	}
+}
+
+// fetchTailscaledDERPMap queries the local tailscaled's LocalAPI for the
+// DERP map it's currently using.
+func fetchTailscaledDERPMap(ctx context.Context) (*tailcfg.DERPMap, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", paths.DefaultTailscaledSocket())
+			},
+		},
+		Timeout: 10 * time.Second,
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://local-tailscaled/localapi/v0/derpmap", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("querying tailscaled localapi: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("tailscaled localapi returned %s: %s", resp.Status, body)
+	}
+
+	var m tailcfg.DERPMap
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return nil, fmt.Errorf("decoding tailscaled derp map: %w", err)
+	}
+	return &m, nil
+}
+
+func fetchURLDERPMap(ctx context.Context, url string) (*tailcfg.DERPMap, error) {
+	if url == "" {
+		return nil, fmt.Errorf("DERPMapSourceURL must be set when DERPMapSource is %q", DERPMapSourceURL)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("fetching %s returned %s: %s", url, resp.Status, body)
+	}
+
+	var m tailcfg.DERPMap
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return nil, fmt.Errorf("decoding derp map from %s: %w", url, err)
+	}
+	return &m, nil
+}
+
+func fetchFileDERPMap(path string) (*tailcfg.DERPMap, error) {
+	if path == "" {
+		return nil, fmt.Errorf("DERPMapSourceURL must be set to a file path when DERPMapSource is %q", DERPMapSourceFile)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var m tailcfg.DERPMap
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		return nil, fmt.Errorf("decoding derp map from %s: %w", path, err)
+	}
+	return &m, nil
+}
@@ -0,0 +1,58 @@
+package derperer
+
+import (
+	"testing"
+
+	"tailscale.com/tailcfg"
+)
+
+// TestMergeSeedMapAddsMissingRegionsOnly checks that mergeSeedMap fills in
+// only the regions m doesn't already have, leaving an existing region (even
+// one with a different node set) untouched.
+func TestMergeSeedMapAddsMissingRegionsOnly(t *testing.T) {
+	d := &Derperer{
+		seedMap: &tailcfg.DERPMap{
+			Regions: map[int]*tailcfg.DERPRegion{
+				1: {RegionID: 1, RegionName: "seed-one"},
+				2: {RegionID: 2, RegionName: "seed-two"},
+			},
+		},
+	}
+
+	m := &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {RegionID: 1, RegionName: "fofa-one"},
+		},
+	}
+
+	d.mergeSeedMap(m)
+
+	if got := m.Regions[1].RegionName; got != "fofa-one" {
+		t.Fatalf("mergeSeedMap overwrote an existing region: got %q", got)
+	}
+	region2, ok := m.Regions[2]
+	if !ok {
+		t.Fatalf("mergeSeedMap did not add missing seed region 2")
+	}
+	if region2.RegionName != "seed-two" {
+		t.Fatalf("unexpected merged region 2: %+v", region2)
+	}
+}
+
+// TestMergeSeedMapNilSeedIsNoop checks that a Derperer with no configured
+// DERPMapSource (seedMap == nil) leaves m untouched.
+func TestMergeSeedMapNilSeedIsNoop(t *testing.T) {
+	d := &Derperer{}
+
+	m := &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {RegionID: 1, RegionName: "fofa-one"},
+		},
+	}
+
+	d.mergeSeedMap(m)
+
+	if len(m.Regions) != 1 {
+		t.Fatalf("expected mergeSeedMap to be a no-op with nil seedMap, got %+v", m.Regions)
+	}
+}
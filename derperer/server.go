@@ -3,19 +3,29 @@ package derperer
 import (
 	"context"
 	"fmt"
+	"html"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/basicauth"
+	"github.com/gofiber/fiber/v2/middleware/cache"
+	"github.com/gofiber/fiber/v2/middleware/compress"
+	"github.com/gofiber/fiber/v2/middleware/limiter"
 	"github.com/gofiber/fiber/v2/middleware/monitor"
 	"github.com/gofiber/fiber/v2/middleware/pprof"
+	"github.com/gofiber/fiber/v2/middleware/recover"
 	"github.com/gofiber/swagger"
+	"github.com/gofiber/websocket/v2"
+	"github.com/koyangyang/derperer/derperer/prober"
+	"github.com/koyangyang/derperer/derpererproto"
 	_ "github.com/koyangyang/derperer/docs"
 	"github.com/koyangyang/derperer/fofa"
 	"github.com/koyangyang/derperer/persistent"
 	"github.com/sourcegraph/conc"
 	"go.uber.org/zap"
+	"tailscale.com/tailcfg"
 )
 
 const FINGERPRINT = `"<h1>DERP</h1>"`
@@ -26,6 +36,16 @@ type Derperer struct {
 	ctx        context.Context
 	derpMap    *Map
 	persistent *persistent.Persistent
+	prober     *prober.Prober
+	broker     *derpererproto.Broker
+	seedMap    *tailcfg.DERPMap
+	wsProxy    *wsProxyRegistry
+
+	lastHealthMu sync.Mutex
+	lastHealth   map[string]nodeHealth
+
+	lastMapMu   sync.Mutex
+	lastMapJSON []byte
 }
 
 type DerpererConfig struct {
@@ -40,10 +60,67 @@ type DerpererConfig struct {
 	ApiKey         string
 	UpdateInterval time.Duration
 	DeleteInterval time.Duration
+
+	// ProbeUDPInterval, ProbeTLSInterval, and ProbeMeshInterval control how
+	// often the prober subsystem re-checks every node in derpMap. Zero
+	// disables that particular probe loop.
+	ProbeUDPInterval  time.Duration
+	ProbeTLSInterval  time.Duration
+	ProbeMeshInterval time.Duration
+
+	// DERPMapSource selects where the seed DERP map is loaded from, in
+	// addition to FOFA scraping. Defaults to DERPMapSourceFofa.
+	DERPMapSource DERPMapSource
+	// DERPMapSourceURL is the URL or file path to read from when
+	// DERPMapSource is "url" or "file" respectively.
+	DERPMapSourceURL string
+
+	// ForceWebsockets makes /derp.json advertise only the WebSocket-upgraded
+	// DERP endpoint of every node by default. Overridable per-request via
+	// the ?force-websockets query param. Requires PublicHostname to be set.
+	ForceWebsockets bool
+	// PublicHostname is this derperer instance's own publicly reachable
+	// hostname, advertised in place of a node's real HostName when
+	// ForceWebsockets rewrites a node. Clients connect to us at
+	// wss://PublicHostname/wsderp/<node>, and we relay to the real node.
+	PublicHostname string
+	// NodeOverrides lets an operator tune individual FOFA-discovered nodes
+	// (by node name) without editing persistent storage by hand.
+	NodeOverrides map[string]NodeOverride
+
+	// PublicRateLimit caps requests per minute per IP against the public
+	// /derp.json and /derp_sort.json endpoints, and (divided by 10, keyed
+	// per-token rather than per-IP) against /update. Zero disables the
+	// limiter.
+	PublicRateLimit int
+	// PublicCacheTTL is how long /derp.json and /derp_sort.json responses
+	// are cached, keyed by query string. Zero disables caching entirely;
+	// gofiber's cache middleware would otherwise fall back to its own
+	// built-in 1-minute default for a zero Expiration.
+	PublicCacheTTL time.Duration
+	// TrustedProxies is the set of proxy IPs/CIDRs allowed to set
+	// X-Forwarded-For for the purposes of per-IP rate limiting.
+	TrustedProxies []string
+	// UpdateTokens is the set of tokens allowed to call /update (as
+	// ?token= or an Authorization: Bearer header), and the key the
+	// per-token limiter on /update rate-limits by. If empty, /update
+	// requires no token, matching prior behavior.
+	UpdateTokens []string
+
+	// DRPCAddress, if set, serves derpererproto.DERPService (typed,
+	// streaming DERP map updates) on this address alongside the Fiber app.
+	DRPCAddress string
 }
 
 func NewDerperer(config DerpererConfig) (*Derperer, error) {
-	app := fiber.New()
+	app := fiber.New(fiber.Config{
+		EnableTrustedProxyCheck: len(config.TrustedProxies) > 0,
+		TrustedProxies:          config.TrustedProxies,
+		ProxyHeader:             fiber.HeaderXForwardedFor,
+	})
+	app.Use(recover.New())
+	app.Use(compress.New(compress.Config{Level: compress.LevelBestSpeed}))
+	app.Use(metricsMiddleware())
 	ctx := context.Background()
 
 	p, err := persistent.NewPersistent(config.DataPath)
@@ -61,19 +138,48 @@ func NewDerperer(config DerpererConfig) (*Derperer, error) {
 		ctx:        ctx,
 		derpMap:    NewMap(&config.DERPMapPolicy),
 		persistent: p,
+		prober: prober.New(prober.Config{
+			UDPInterval:  config.ProbeUDPInterval,
+			TLSInterval:  config.ProbeTLSInterval,
+			MeshInterval: config.ProbeMeshInterval,
+		}),
+		broker:  derpererproto.NewBroker(),
+		wsProxy: newWSProxyRegistry(),
 	}
 
 	if err := derperer.persistent.Load("derp_map", derperer.derpMap); err != nil {
 		zap.L().Error("failed to load derp_map", zap.Error(err))
 	}
 
+	if err := derperer.loadSeedDERPMap(); err != nil {
+		zap.L().Error("failed to load seed derp map", zap.Error(err))
+	}
+
 	app.Get("/swagger/*", swagger.HandlerDefault)
 
 	app.Get("/", derperer.index)
 
-	app.Get("/derp.json", derperer.getDerp)
-	app.Get("/derp_sort.json", derperer.sortDerp)
-	app.Get("/update", derperer.updateTailscale)
+	publicCache := cache.New(cache.Config{
+		Next:         func(c *fiber.Ctx) bool { return config.PublicCacheTTL <= 0 },
+		Expiration:   config.PublicCacheTTL,
+		CacheHeader:  "X-Cache-Status",
+		KeyGenerator: func(c *fiber.Ctx) string { return c.OriginalURL() },
+	})
+	publicLimiter := publicRateLimiter(config.PublicRateLimit)
+	updateRate := config.PublicRateLimit / 10
+	if config.PublicRateLimit > 0 && updateRate == 0 {
+		updateRate = 1
+	}
+	updateLimiter := updateTokenLimiter(updateRate)
+
+	app.Get("/derp.json", publicLimiter, publicCache, derperer.getDerp)
+	app.Get("/derp_sort.json", publicLimiter, publicCache, derperer.sortDerp)
+	app.Get("/update", requireUpdateToken(config.UpdateTokens), updateLimiter, derperer.updateTailscale)
+
+	app.Get("/probe/status", derperer.probeStatus)
+	app.Get("/probe/status.html", derperer.probeStatusHTML)
+
+	app.Get("/wsderp/:node", wsProxyUpgrade, websocket.New(derperer.wsProxyHandler))
 
 	if config.AdminToken != "" {
 		adminApi := app.Group("/admin", basicauth.New(basicauth.Config{
@@ -90,6 +196,8 @@ func NewDerperer(config DerpererConfig) (*Derperer, error) {
 		}))
 		adminApi.Get("/config", derperer.getConfig)
 		adminApi.Post("/config", derperer.setConfig)
+
+		registerMetrics(adminApi)
 	}
 
 	return derperer, nil
@@ -108,20 +216,26 @@ func (d *Derperer) RemoveFofaData() {
 func (d *Derperer) FetchFofaData() {
 	logger := zap.L()
 	logger.Info("fetching fofa")
+	start := time.Now()
 	res, finish, err := d.config.FofaClient.Query(FINGERPRINT, d.config.FetchBatch, -1)
 	if err != nil {
 		logger.Error("failed to query fofa", zap.Error(err))
+		fofaFetchTotal.WithLabelValues("error").Inc()
 	}
 	for {
 		select {
 		case r := <-res:
 			d.derpMap.AddFofaResult(r)
+			updateDERPNodeMetrics(d.derpMap)
+			d.publishMapUpdate(derpererproto.MapUpdateKind_ADDED)
 
 			if err := d.persistent.Save("derp_map", d.derpMap); err != nil {
 				logger.Error("failed to save derp_map", zap.Error(err))
 			}
 		case <-finish:
 			logger.Info("fofa query finished")
+			fofaFetchTotal.WithLabelValues("ok").Inc()
+			fofaFetchDuration.Observe(time.Since(start).Seconds())
 			return
 		}
 	}
@@ -132,6 +246,32 @@ func (d *Derperer) Start() {
 
 	wg.Go(d.derpMap.Recheck)
 
+	wg.Go(func() {
+		d.prober.RunUDPLoop(d.ctx, d.allNodes)
+	})
+	wg.Go(func() {
+		d.prober.RunTLSLoop(d.ctx, d.allNodes)
+	})
+	wg.Go(func() {
+		d.prober.RunMeshLoop(d.ctx, d.allNodes)
+	})
+
+	// Recheck updates node liveness in the background and doesn't publish
+	// into the broker itself, so poll for what it changed on the same tick
+	// that already refreshes metrics and health events.
+	wg.Go(func() {
+		t := time.NewTicker(time.Minute)
+		defer t.Stop()
+		for range t.C {
+			updateDERPNodeMetrics(d.derpMap)
+			d.updateDERPNodeLatencyMetrics()
+			d.publishNodeHealthEvents()
+			d.publishMapUpdateOnChange()
+		}
+	})
+
+	wg.Go(d.startDRPC)
+
 	wg.Go(func() {
 		for {
 			var lastFetch time.Time
@@ -203,6 +343,7 @@ func (d *Derperer) index(c *fiber.Ctx) error {
 // @Param status query string false "alive|error|all" Enums(alive, error, all)
 // @Param latency-limit query string false "latency limit, e.g. 500ms"
 // @Param bandwidth-limit query string string "bandwidth limit, e.g. 2Mbps"
+// @Param force-websockets query bool false "advertise only the WebSocket-upgraded DERP endpoint"
 // @Produce json
 // @Router /derp.json [get]
 func (d *Derperer) getDerp(c *fiber.Ctx) error {
@@ -214,6 +355,13 @@ func (d *Derperer) getDerp(c *fiber.Ctx) error {
 	if err != nil {
 		return err
 	}
+
+	d.mergeSeedMap(m)
+	applyNodeOverrides(m, d.config.NodeOverrides)
+	if c.QueryBool("force-websockets", d.config.ForceWebsockets) {
+		d.rewriteForceWebSockets(m)
+	}
+
 	return c.JSON(m)
 }
 
@@ -222,6 +370,9 @@ func (d *Derperer) sortDerp(c *fiber.Ctx) error {
 	if err != nil {
 		return err
 	}
+	d.mergeSeedMap(m)
+	d.evictUnhealthy(m)
+	applyNodeOverrides(m, d.config.NodeOverrides)
 	return c.JSON(m)
 }
 
@@ -230,7 +381,15 @@ func (d *Derperer) updateTailscale(c *fiber.Ctx) error {
 	if err != nil {
 		return err
 	}
-	t := UpdateACL(m.Regions, d.config.Account, d.config.ApiKey)
+	d.mergeSeedMap(m)
+	d.evictUnhealthy(m)
+	applyNodeOverrides(m, d.config.NodeOverrides)
+	t, err := UpdateACL(m.Regions, d.config.Account, d.config.ApiKey)
+	if err != nil {
+		tailscaleACLUpdateTotal.WithLabelValues("error").Inc()
+		return err
+	}
+	tailscaleACLUpdateTotal.WithLabelValues("ok").Inc()
 	return c.JSON(t)
 }
 
@@ -239,10 +398,96 @@ func (d *Derperer) autoupdateTailscale() {
 	if err != nil {
 		return
 	}
-	t := UpdateACL(m.Regions, d.config.Account, d.config.ApiKey)
+	d.mergeSeedMap(m)
+	d.evictUnhealthy(m)
+	applyNodeOverrides(m, d.config.NodeOverrides)
+	t, err := UpdateACL(m.Regions, d.config.Account, d.config.ApiKey)
+	if err != nil {
+		tailscaleACLUpdateTotal.WithLabelValues("error").Inc()
+		zap.L().Error("failed to update tailscale acl", zap.Error(err))
+		return
+	}
+	tailscaleACLUpdateTotal.WithLabelValues("ok").Inc()
 	fmt.Println(t)
 }
 
+// allNodes returns every node currently in derpMap, across all regions,
+// for the prober loops to probe.
+func (d *Derperer) allNodes() []*tailcfg.DERPNode {
+	m, err := d.derpMap.FilterDERPMap(DERPMapFilter{Status: "all"})
+	if err != nil {
+		zap.L().Error("failed to list nodes for probing", zap.Error(err))
+		return nil
+	}
+	d.mergeSeedMap(m)
+	var nodes []*tailcfg.DERPNode
+	for _, region := range m.Regions {
+		nodes = append(nodes, region.Nodes...)
+	}
+	return nodes
+}
+
+// evictUnhealthy drops nodes the prober has marked evictable (too many
+// consecutive UDP or TLS probe failures) from m in place, so that
+// updateTailscale never pushes a known-broken relay into the ACL.
+func (d *Derperer) evictUnhealthy(m *tailcfg.DERPMap) {
+	for regionID, region := range m.Regions {
+		kept := region.Nodes[:0]
+		for _, n := range region.Nodes {
+			if d.prober.ShouldEvict(n.Name) {
+				zap.L().Warn("evicting unhealthy node from DERP map results", zap.String("node", n.Name))
+				continue
+			}
+			kept = append(kept, n)
+		}
+		region.Nodes = kept
+		if len(region.Nodes) == 0 {
+			delete(m.Regions, regionID)
+		}
+	}
+}
+
+// @Summary Get Prober Status
+// @Produce json
+// @Router /probe/status [get]
+func (d *Derperer) probeStatus(c *fiber.Ctx) error {
+	nodes, pairs := d.prober.Snapshot()
+	return c.JSON(fiber.Map{
+		"nodes": nodes,
+		"pairs": pairs,
+	})
+}
+
+// @Summary Get Prober Status (HTML)
+// @Produce html
+// @Router /probe/status.html [get]
+func (d *Derperer) probeStatusHTML(c *fiber.Ctx) error {
+	nodes, _ := d.prober.Snapshot()
+
+	// name and r.Reason originate from FOFA-scraped, internet-untrusted
+	// DERP nodes (node name/HostName, and dial/cert error text that can
+	// itself embed attacker-chosen hostnames), and this endpoint is public
+	// and unauthenticated, so they must be escaped before going into HTML.
+	var good, bad strings.Builder
+	for name, r := range nodes {
+		escapedName := html.EscapeString(name)
+		switch r.Status {
+		case prober.StatusGood:
+			fmt.Fprintf(&good, "<li>%s (rtt %s)</li>", escapedName, html.EscapeString(r.RTT.String()))
+		default:
+			fmt.Fprintf(&bad, "<li>%s &mdash; %s</li>", escapedName, html.EscapeString(r.Reason))
+		}
+	}
+
+	c.Set("Content-Type", "text/html")
+	return c.SendString(fmt.Sprintf(`
+<h2>good</h2>
+<ul>%s</ul>
+<h2>bad</h2>
+<ul>%s</ul>
+		`, good.String(), bad.String()))
+}
+
 // @securityDefinitions.basic BasicAuth
 
 // @Summary Admin Index
@@ -0,0 +1,252 @@
+package derperer
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+	"go.uber.org/zap"
+	"tailscale.com/tailcfg"
+)
+
+// wsProxyDialTimeout bounds the TLS dial and HTTP Upgrade exchange with the
+// upstream node, matching prober.Config.TLSTimeout's rationale: a
+// FOFA-discovered node can accept the TCP connection and then stall
+// indefinitely during the handshake.
+const wsProxyDialTimeout = 10 * time.Second
+
+// wsProxyTarget is the real, non-WebSocket upstream a forced-websocket
+// node should be relayed to.
+type wsProxyTarget struct {
+	network  string
+	addr     string
+	insecure bool
+}
+
+// wsProxyRegistry maps a node name (as advertised in /derp.json) to the
+// real upstream it should be relayed to, once rewriteForceWebSockets has
+// pointed the advertised HostName at us instead of the node itself.
+// tailcfg.DERPNode has no field that makes a real DERP node accept only a
+// WebSocket upgrade, so "forcing websockets" only works if something
+// terminates a real WebSocket connection and relays it — that's us.
+type wsProxyRegistry struct {
+	mu      sync.RWMutex
+	targets map[string]wsProxyTarget
+}
+
+func newWSProxyRegistry() *wsProxyRegistry {
+	return &wsProxyRegistry{targets: make(map[string]wsProxyTarget)}
+}
+
+func (r *wsProxyRegistry) set(node string, target wsProxyTarget) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.targets[node] = target
+}
+
+func (r *wsProxyRegistry) get(node string) (wsProxyTarget, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.targets[node]
+	return t, ok
+}
+
+// rewriteForceWebSockets mutates m in place so that every node advertises
+// d.config.PublicHostname, reachable only via the /wsderp/:node WebSocket
+// endpoint, instead of its real HostName/DERPPort. The real address is
+// recorded in d.wsProxy so wsProxyHandler can relay to it. This is for
+// clients behind restrictive middleboxes that mangle the plain DERP
+// HTTP-Upgrade handshake but pass through a regular wss:// connection.
+func (d *Derperer) rewriteForceWebSockets(m *tailcfg.DERPMap) {
+	for _, region := range m.Regions {
+		for _, n := range region.Nodes {
+			port := n.DERPPort
+			if port == 0 {
+				port = 443
+			}
+			d.wsProxy.set(n.Name, wsProxyTarget{
+				network:  "tcp",
+				addr:     net.JoinHostPort(n.HostName, fmt.Sprintf("%d", port)),
+				insecure: n.InsecureForTests,
+			})
+
+			n.HostName = d.config.PublicHostname
+			n.DERPPort = 443
+			n.CanPort80 = false
+		}
+	}
+}
+
+// wsProxyUpgrade is mounted ahead of wsProxyHandler to reject any request
+// that isn't a genuine WebSocket upgrade, so a forced-websocket node can't
+// be reached any other way.
+func wsProxyUpgrade(c *fiber.Ctx) error {
+	if !websocket.IsWebSocketUpgrade(c) {
+		return fiber.ErrUpgradeRequired
+	}
+	return c.Next()
+}
+
+// dialUpstreamDERP opens a real connection to target the way a genuine DERP
+// client would: TLS, then an HTTP Upgrade request to /derp. The real node's
+// HTTPS endpoint requires this handshake before it'll accept the binary DERP
+// protocol on the wire, so a plain TCP dial (what this used to do) fails
+// against every real node.
+func dialUpstreamDERP(target wsProxyTarget) (net.Conn, error) {
+	deadline := time.Now().Add(wsProxyDialTimeout)
+
+	dialer := &net.Dialer{Deadline: deadline}
+	conn, err := tls.DialWithDialer(dialer, target.network, target.addr, &tls.Config{InsecureSkipVerify: target.insecure})
+	if err != nil {
+		return nil, fmt.Errorf("tls dial: %w", err)
+	}
+	// Reuse the same deadline for the Upgrade roundtrip rather than giving
+	// it a fresh wsProxyDialTimeout, so the whole handshake (connect + TLS +
+	// Upgrade) is bounded by wsProxyDialTimeout total, not double it.
+	if err := conn.SetDeadline(deadline); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("set handshake deadline: %w", err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "https://"+target.addr+"/derp", nil)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("build upgrade request: %w", err)
+	}
+	req.Header.Set("Upgrade", "derp")
+	req.Header.Set("Connection", "Upgrade")
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("write upgrade request: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("read upgrade response: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("upstream refused upgrade: %s", resp.Status)
+	}
+
+	// The handshake is done; don't keep imposing wsProxyDialTimeout on the
+	// long-lived relay that follows.
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("clear handshake deadline: %w", err)
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn whose Read is served from r first, so bytes the
+// upstream sent immediately after the 101 response (already consumed into
+// bufio.Reader's buffer while reading the response headers) aren't dropped.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) { return b.r.Read(p) }
+
+// wsProxyHandler relays raw DERP protocol bytes between the caller's
+// WebSocket connection and a real, TLS+HTTP-Upgrade-handshaked connection to
+// the DERP node registered for the :node route param.
+func (d *Derperer) wsProxyHandler(c *websocket.Conn) {
+	node := c.Params("node")
+	target, ok := d.wsProxy.get(node)
+	if !ok {
+		_ = c.Close()
+		return
+	}
+
+	upstream, err := dialUpstreamDERP(target)
+	if err != nil {
+		zap.L().Warn("ws proxy: dial upstream", zap.String("node", node), zap.String("addr", target.addr), zap.Error(err))
+		_ = c.Close()
+		return
+	}
+	defer upstream.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			_, msg, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			if _, err := upstream.Write(msg); err != nil {
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := upstream.Read(buf)
+		// Forward whatever was read before checking err: io.Reader
+		// implementations (including TLS conns) may return n > 0 alongside
+		// EOF/close_notify on the same call, e.g. a final frame arriving
+		// with the upstream's close, and that shouldn't be dropped.
+		if n > 0 {
+			if werr := c.WriteMessage(websocket.BinaryMessage, buf[:n]); werr != nil {
+				break
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				zap.L().Debug("ws proxy: upstream read", zap.String("node", node), zap.Error(err))
+			}
+			break
+		}
+	}
+	<-done
+}
+
+// NodeOverride lets an operator tune an individual FOFA-discovered node
+// without hand-editing persistent storage. Nil fields leave the
+// FOFA-discovered value untouched.
+type NodeOverride struct {
+	STUNOnly         *bool `json:"stunOnly,omitempty"`
+	DERPPort         *int  `json:"derpPort,omitempty"`
+	InsecureForTests *bool `json:"insecureForTests,omitempty"`
+}
+
+// applyNodeOverrides mutates m in place, applying any configured
+// per-node overrides by node name.
+func applyNodeOverrides(m *tailcfg.DERPMap, overrides map[string]NodeOverride) {
+	if len(overrides) == 0 {
+		return
+	}
+	for _, region := range m.Regions {
+		for _, n := range region.Nodes {
+			o, ok := overrides[n.Name]
+			if !ok {
+				continue
+			}
+			if o.STUNOnly != nil {
+				n.STUNOnly = *o.STUNOnly
+			}
+			if o.DERPPort != nil {
+				n.DERPPort = *o.DERPPort
+			}
+			if o.InsecureForTests != nil {
+				n.InsecureForTests = *o.InsecureForTests
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package derpererproto
+
+import "sync"
+
+// Broker fans out MapUpdate and NodeHealthEvent events to however many
+// StreamMap/SubscribeNodeHealth subscribers are currently connected. It
+// applies no backpressure of its own beyond a bounded per-subscriber
+// channel: a slow subscriber drops events rather than blocking publishers.
+type Broker struct {
+	mu         sync.Mutex
+	mapSubs    map[int]chan *MapUpdate
+	healthSubs map[int]chan *NodeHealthEvent
+	nextSubID  int
+}
+
+// NewBroker returns an empty Broker ready for subscribers and publishers.
+func NewBroker() *Broker {
+	return &Broker{
+		mapSubs:    make(map[int]chan *MapUpdate),
+		healthSubs: make(map[int]chan *NodeHealthEvent),
+	}
+}
+
+// SubscribeMap registers a new MapUpdate subscriber and returns its channel
+// along with an unsubscribe func that must be called when the subscriber
+// goes away.
+func (b *Broker) SubscribeMap() (<-chan *MapUpdate, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.nextSubID
+	b.nextSubID++
+	ch := make(chan *MapUpdate, 16)
+	b.mapSubs[id] = ch
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.mapSubs, id)
+		close(ch)
+	}
+}
+
+// SubscribeHealth registers a new NodeHealthEvent subscriber.
+func (b *Broker) SubscribeHealth() (<-chan *NodeHealthEvent, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.nextSubID
+	b.nextSubID++
+	ch := make(chan *NodeHealthEvent, 16)
+	b.healthSubs[id] = ch
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.healthSubs, id)
+		close(ch)
+	}
+}
+
+// PublishMapUpdate fans update out to every current StreamMap subscriber,
+// dropping it for any subscriber whose channel is full.
+func (b *Broker) PublishMapUpdate(update *MapUpdate) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range b.mapSubs {
+		select {
+		case ch <- update:
+		default:
+		}
+	}
+}
+
+// PublishNodeHealth fans event out to every current SubscribeNodeHealth
+// subscriber, dropping it for any subscriber whose channel is full.
+func (b *Broker) PublishNodeHealth(event *NodeHealthEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range b.healthSubs {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
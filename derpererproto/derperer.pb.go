@@ -0,0 +1,59 @@
+// Generated from derperer.proto. Hand-maintained until protoc-gen-go-drpc
+// is wired into the build; keep in sync with derperer.proto.
+
+package derpererproto
+
+import "fmt"
+
+type FilterRequest struct {
+	Status         string `json:"status,omitempty"`
+	LatencyLimit   string `json:"latency_limit,omitempty"`
+	BandwidthLimit string `json:"bandwidth_limit,omitempty"`
+}
+
+func (m *FilterRequest) Reset()         { *m = FilterRequest{} }
+func (m *FilterRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (m *FilterRequest) ProtoMessage()  {}
+
+type DERPMap struct {
+	JSON []byte `json:"json,omitempty"`
+}
+
+func (m *DERPMap) Reset()         { *m = DERPMap{} }
+func (m *DERPMap) String() string { return fmt.Sprintf("DERPMap(%d bytes)", len(m.JSON)) }
+func (m *DERPMap) ProtoMessage()  {}
+
+type MapUpdateKind int32
+
+const (
+	MapUpdateKind_UNKNOWN        MapUpdateKind = 0
+	MapUpdateKind_ADDED          MapUpdateKind = 1
+	MapUpdateKind_REMOVED        MapUpdateKind = 2
+	MapUpdateKind_STATUS_CHANGED MapUpdateKind = 3
+)
+
+type MapUpdate struct {
+	Kind     MapUpdateKind `json:"kind,omitempty"`
+	NodeName string        `json:"node_name,omitempty"`
+	Map      *DERPMap      `json:"map,omitempty"`
+}
+
+func (m *MapUpdate) Reset()         { *m = MapUpdate{} }
+func (m *MapUpdate) String() string { return fmt.Sprintf("%+v", *m) }
+func (m *MapUpdate) ProtoMessage()  {}
+
+type NodeHealthEvent struct {
+	NodeName string `json:"node_name,omitempty"`
+	Status   string `json:"status,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+func (m *NodeHealthEvent) Reset()         { *m = NodeHealthEvent{} }
+func (m *NodeHealthEvent) String() string { return fmt.Sprintf("%+v", *m) }
+func (m *NodeHealthEvent) ProtoMessage()  {}
+
+type Empty struct{}
+
+func (m *Empty) Reset()         { *m = Empty{} }
+func (m *Empty) String() string { return "Empty{}" }
+func (m *Empty) ProtoMessage()  {}
@@ -0,0 +1,169 @@
+// Generated from derperer.proto via protoc-gen-go-drpc. Hand-maintained
+// until that generator is wired into the build; keep in sync with
+// derperer.proto.
+
+package derpererproto
+
+import (
+	"context"
+
+	"storj.io/drpc"
+)
+
+type DRPCDERPServiceClient interface {
+	DRPCConn() drpc.Conn
+
+	GetMap(ctx context.Context, in *FilterRequest) (*DERPMap, error)
+	StreamMap(ctx context.Context, in *FilterRequest) (DRPCDERPService_StreamMapClient, error)
+	SubscribeNodeHealth(ctx context.Context, in *Empty) (DRPCDERPService_SubscribeNodeHealthClient, error)
+}
+
+type drpcDERPServiceClient struct {
+	cc drpc.Conn
+}
+
+func NewDRPCDERPServiceClient(cc drpc.Conn) DRPCDERPServiceClient {
+	return &drpcDERPServiceClient{cc}
+}
+
+func (c *drpcDERPServiceClient) DRPCConn() drpc.Conn { return c.cc }
+
+func (c *drpcDERPServiceClient) GetMap(ctx context.Context, in *FilterRequest) (*DERPMap, error) {
+	out := new(DERPMap)
+	err := c.cc.Invoke(ctx, "/derpererproto.DERPService/GetMap", jsonEncoding{}, in, out)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type DRPCDERPService_StreamMapClient interface {
+	drpc.Stream
+	Recv() (*MapUpdate, error)
+}
+
+func (c *drpcDERPServiceClient) StreamMap(ctx context.Context, in *FilterRequest) (DRPCDERPService_StreamMapClient, error) {
+	stream, err := c.cc.NewStream(ctx, "/derpererproto.DERPService/StreamMap", jsonEncoding{})
+	if err != nil {
+		return nil, err
+	}
+	x := &drpcDERPService_StreamMapClient{stream}
+	if err := x.MsgSend(in, jsonEncoding{}); err != nil {
+		return nil, err
+	}
+	if err := x.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type drpcDERPService_StreamMapClient struct {
+	drpc.Stream
+}
+
+func (x *drpcDERPService_StreamMapClient) Recv() (*MapUpdate, error) {
+	m := new(MapUpdate)
+	if err := x.MsgRecv(m, jsonEncoding{}); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+type DRPCDERPService_SubscribeNodeHealthClient interface {
+	drpc.Stream
+	Recv() (*NodeHealthEvent, error)
+}
+
+func (c *drpcDERPServiceClient) SubscribeNodeHealth(ctx context.Context, in *Empty) (DRPCDERPService_SubscribeNodeHealthClient, error) {
+	stream, err := c.cc.NewStream(ctx, "/derpererproto.DERPService/SubscribeNodeHealth", jsonEncoding{})
+	if err != nil {
+		return nil, err
+	}
+	x := &drpcDERPService_SubscribeNodeHealthClient{stream}
+	if err := x.MsgSend(in, jsonEncoding{}); err != nil {
+		return nil, err
+	}
+	if err := x.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type drpcDERPService_SubscribeNodeHealthClient struct {
+	drpc.Stream
+}
+
+func (x *drpcDERPService_SubscribeNodeHealthClient) Recv() (*NodeHealthEvent, error) {
+	m := new(NodeHealthEvent)
+	if err := x.MsgRecv(m, jsonEncoding{}); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// DRPCDERPServiceServer is implemented by derperer to serve the typed
+// DERPService contract.
+type DRPCDERPServiceServer interface {
+	GetMap(context.Context, *FilterRequest) (*DERPMap, error)
+	StreamMap(*FilterRequest, DRPCDERPService_StreamMapStream) error
+	SubscribeNodeHealth(*Empty, DRPCDERPService_SubscribeNodeHealthStream) error
+}
+
+type DRPCDERPService_StreamMapStream interface {
+	drpc.Stream
+	Send(*MapUpdate) error
+}
+
+type drpcDERPService_StreamMapStream struct {
+	drpc.Stream
+}
+
+func (x *drpcDERPService_StreamMapStream) Send(m *MapUpdate) error {
+	return x.MsgSend(m, jsonEncoding{})
+}
+
+type DRPCDERPService_SubscribeNodeHealthStream interface {
+	drpc.Stream
+	Send(*NodeHealthEvent) error
+}
+
+type drpcDERPService_SubscribeNodeHealthStream struct {
+	drpc.Stream
+}
+
+func (x *drpcDERPService_SubscribeNodeHealthStream) Send(m *NodeHealthEvent) error {
+	return x.MsgSend(m, jsonEncoding{})
+}
+
+// DRPCDERPServiceDescription registers DRPCDERPServiceServer handlers on a
+// drpc.Mux.
+type DRPCDERPServiceDescription struct{}
+
+func (DRPCDERPServiceDescription) NumMethods() int { return 3 }
+
+func (DRPCDERPServiceDescription) Method(n int) (string, drpc.Encoding, drpc.Receiver, interface{}, bool) {
+	switch n {
+	case 0:
+		return "/derpererproto.DERPService/GetMap", jsonEncoding{},
+			func(srv interface{}, ctx context.Context, in1, _ interface{}) (interface{}, error) {
+				return srv.(DRPCDERPServiceServer).GetMap(ctx, in1.(*FilterRequest))
+			}, FilterRequest{}, true
+	case 1:
+		return "/derpererproto.DERPService/StreamMap", jsonEncoding{},
+			func(srv interface{}, _ context.Context, in1, stream interface{}) (interface{}, error) {
+				return nil, srv.(DRPCDERPServiceServer).StreamMap(in1.(*FilterRequest), &drpcDERPService_StreamMapStream{stream.(drpc.Stream)})
+			}, FilterRequest{}, true
+	case 2:
+		return "/derpererproto.DERPService/SubscribeNodeHealth", jsonEncoding{},
+			func(srv interface{}, _ context.Context, in1, stream interface{}) (interface{}, error) {
+				return nil, srv.(DRPCDERPServiceServer).SubscribeNodeHealth(in1.(*Empty), &drpcDERPService_SubscribeNodeHealthStream{stream.(drpc.Stream)})
+			}, Empty{}, true
+	default:
+		return "", nil, nil, nil, false
+	}
+}
+
+// DRPCRegisterDERPService registers srv on mux under the DERPService name.
+func DRPCRegisterDERPService(mux drpc.Mux, srv DRPCDERPServiceServer) error {
+	return mux.Register(srv, DRPCDERPServiceDescription{})
+}
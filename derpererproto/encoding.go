@@ -0,0 +1,21 @@
+package derpererproto
+
+import (
+	"encoding/json"
+
+	"storj.io/drpc"
+)
+
+// jsonEncoding is a minimal drpc.Encoding that marshals messages as JSON.
+// Real protobuf wire encoding can replace this once protoc-gen-go-drpc is
+// wired into the build; the RPC contract and streaming semantics declared
+// in derperer.proto don't change either way.
+type jsonEncoding struct{}
+
+func (jsonEncoding) Marshal(msg drpc.Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (jsonEncoding) Unmarshal(buf []byte, msg drpc.Message) error {
+	return json.Unmarshal(buf, msg)
+}